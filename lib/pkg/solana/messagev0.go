@@ -0,0 +1,496 @@
+package solana
+
+import (
+	"crypto/ed25519"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// v0MessageVersionByte is written before a v0 message's header so a reader
+// can distinguish it from a legacy message, whose header always starts
+// with NumSignatures which is well under 0x80.
+const v0MessageVersionByte = 0x80
+
+// LookupTable is a caller-supplied view of an on-chain Address Lookup
+// Table: the table's own account key plus the ordered account keys it
+// resolves to. CompileV0 consults it to turn accounts referenced by an
+// instruction into lookup-table indexes instead of static account keys.
+type LookupTable struct {
+	Key      ed25519.PublicKey
+	Accounts []ed25519.PublicKey
+}
+
+// MessageAddressTableLookup records, for a single lookup table referenced
+// by a v0 message, which of its entries are loaded as writable vs
+// read-only accounts.
+type MessageAddressTableLookup struct {
+	AccountKey      ed25519.PublicKey
+	WritableIndexes []byte
+	ReadonlyIndexes []byte
+}
+
+// MessageV0 is the versioned message format that adds Address Lookup
+// Table support on top of the legacy Message: instructions can reference
+// accounts that live in a lookup table instead of being listed statically
+// in Accounts.
+type MessageV0 struct {
+	Header              Header
+	Accounts            []ed25519.PublicKey
+	RecentBlockhash     Blockhash
+	Instructions        []CompiledInstruction
+	AddressTableLookups []MessageAddressTableLookup
+}
+
+// TransactionV0 wraps a MessageV0 the same way Transaction wraps a legacy
+// Message.
+type TransactionV0 struct {
+	Signatures []Signature
+	Message    MessageV0
+}
+
+// CompileV0 builds a TransactionV0 from a set of instructions and lookup
+// tables, resolving each account referenced by an instruction to either a
+// static account index (payer, signers, and anything not found in a
+// lookup table) or a lookup-table index. It preserves the same
+// signers-before-non-signers, writable-before-read-only ordering
+// invariants that NewTransaction enforces for the static account list.
+func CompileV0(payer ed25519.PublicKey, instructions []Instruction, lookupTables ...LookupTable) (TransactionV0, error) {
+	staticAccounts := []AccountMeta{
+		{
+			PublicKey:  payer,
+			IsSigner:   true,
+			IsWritable: true,
+			isPayer:    true,
+		},
+	}
+
+	type lookupHit struct {
+		table    int
+		index    int
+		writable bool
+	}
+	looked := map[string]lookupHit{}
+	for ti, lt := range lookupTables {
+		for idx, acc := range lt.Accounts {
+			looked[string(acc)] = lookupHit{table: ti, index: idx}
+		}
+	}
+
+	// Any account that must be a signer, or is the payer/program, cannot
+	// be sourced from a lookup table: only plain writable/readonly
+	// accounts can be.
+	resolvable := func(a AccountMeta) bool {
+		if a.IsSigner || a.isPayer || a.isProgram {
+			return false
+		}
+		_, ok := looked[string(a.PublicKey)]
+		return ok
+	}
+
+	var dynamic []AccountMeta
+	for _, i := range instructions {
+		staticAccounts = append(staticAccounts, AccountMeta{PublicKey: i.Program, isProgram: true})
+		for _, a := range i.Accounts {
+			if resolvable(a) {
+				dynamic = append(dynamic, a)
+			} else {
+				staticAccounts = append(staticAccounts, a)
+			}
+		}
+	}
+
+	staticAccounts = filterUnique(staticAccounts)
+	sort.Sort(SortableAccountMeta(staticAccounts))
+	dynamic = filterUnique(dynamic)
+
+	var m MessageV0
+	for _, account := range staticAccounts {
+		m.Accounts = append(m.Accounts, account.PublicKey)
+		if account.IsSigner {
+			m.Header.NumSignatures++
+			if !account.IsWritable {
+				m.Header.NumReadonlySigned++
+			}
+		} else if !account.IsWritable {
+			m.Header.NumReadOnly++
+		}
+	}
+
+	// Group the dynamic accounts by which lookup table they came from,
+	// keeping writable and read-only entries separate to mirror the
+	// runtime's own account-loading order.
+	lookupsByTable := map[int]*MessageAddressTableLookup{}
+	dynamicIndex := map[string]int{}
+	for _, a := range dynamic {
+		hit := looked[string(a.PublicKey)]
+		lut, ok := lookupsByTable[hit.table]
+		if !ok {
+			lut = &MessageAddressTableLookup{AccountKey: lookupTables[hit.table].Key}
+			lookupsByTable[hit.table] = lut
+		}
+		if a.IsWritable {
+			lut.WritableIndexes = append(lut.WritableIndexes, byte(hit.index))
+		} else {
+			lut.ReadonlyIndexes = append(lut.ReadonlyIndexes, byte(hit.index))
+		}
+	}
+
+	// Deterministic table order; dynamic account indexes for compiled
+	// instructions are assigned writable-first across all tables, then
+	// read-only, matching how the runtime lays out loaded addresses.
+	tableOrder := make([]int, 0, len(lookupsByTable))
+	for ti := range lookupsByTable {
+		tableOrder = append(tableOrder, ti)
+	}
+	sort.Ints(tableOrder)
+
+	staticLen := len(m.Accounts)
+	nextIndex := staticLen
+	for _, ti := range tableOrder {
+		lut := lookupsByTable[ti]
+		for _, idx := range lut.WritableIndexes {
+			dynamicIndex[lookupKey(lookupTables[ti].Key, idx)] = nextIndex
+			nextIndex++
+		}
+		m.AddressTableLookups = append(m.AddressTableLookups, *lut)
+	}
+	for _, ti := range tableOrder {
+		lut := lookupsByTable[ti]
+		for _, idx := range lut.ReadonlyIndexes {
+			dynamicIndex[lookupKey(lookupTables[ti].Key, idx)] = nextIndex
+			nextIndex++
+		}
+	}
+
+	resolveIndex := func(pub ed25519.PublicKey) int {
+		if idx := indexOf(m.Accounts, pub); idx >= 0 {
+			return idx
+		}
+		hit, ok := looked[string(pub)]
+		if !ok {
+			return -1
+		}
+		return dynamicIndex[lookupKey(lookupTables[hit.table].Key, byte(hit.index))]
+	}
+
+	for _, i := range instructions {
+		c := CompiledInstruction{
+			ProgramIndex: byte(indexOf(m.Accounts, i.Program)),
+			Data:         i.Data,
+		}
+		for _, a := range i.Accounts {
+			c.Accounts = append(c.Accounts, byte(resolveIndex(a.PublicKey)))
+		}
+		m.Instructions = append(m.Instructions, c)
+	}
+
+	return TransactionV0{
+		Signatures: make([]Signature, m.Header.NumSignatures),
+		Message:    m,
+	}, nil
+}
+
+func lookupKey(tableKey ed25519.PublicKey, index byte) string {
+	return string(append(append([]byte{}, tableKey...), index))
+}
+
+// SetBlockhash sets the transaction's recent blockhash (or, for a durable
+// nonce transaction, the current stored nonce value).
+func (t *TransactionV0) SetBlockhash(bh Blockhash) {
+	t.Message.RecentBlockhash = bh
+}
+
+// Sign signs the transaction with the given signers, in the same manner
+// as Transaction.Sign.
+func (t *TransactionV0) Sign(signers ...ed25519.PrivateKey) error {
+	messageBytes := t.Message.Marshal()
+
+	for _, s := range signers {
+		pub := s.Public().(ed25519.PublicKey)
+		index := indexOf(t.Message.Accounts, pub)
+		if index < 0 {
+			return errors.Errorf("signing account is not in the account list")
+		}
+		if index >= len(t.Signatures) {
+			return errors.Errorf("signing account is not in the list of signers")
+		}
+		copy(t.Signatures[index][:], ed25519.Sign(s, messageBytes))
+	}
+
+	return nil
+}
+
+// Marshal serializes the v0 message, prefixed with the version byte, per
+// https://docs.solana.com/proposals/versioned-transactions.
+func (m *MessageV0) Marshal() []byte {
+	var buf []byte
+	buf = append(buf, v0MessageVersionByte)
+	buf = append(buf, m.Header.NumSignatures, m.Header.NumReadonlySigned, m.Header.NumReadOnly)
+	buf = append(buf, encodeCompactArrayLen(len(m.Accounts))...)
+	for _, a := range m.Accounts {
+		buf = append(buf, a...)
+	}
+	buf = append(buf, m.RecentBlockhash[:]...)
+	buf = append(buf, encodeCompactArrayLen(len(m.Instructions))...)
+	for _, ci := range m.Instructions {
+		buf = append(buf, ci.ProgramIndex)
+		buf = append(buf, encodeCompactArrayLen(len(ci.Accounts))...)
+		buf = append(buf, ci.Accounts...)
+		buf = append(buf, encodeCompactArrayLen(len(ci.Data))...)
+		buf = append(buf, ci.Data...)
+	}
+	buf = append(buf, encodeCompactArrayLen(len(m.AddressTableLookups))...)
+	for _, l := range m.AddressTableLookups {
+		buf = append(buf, l.AccountKey...)
+		buf = append(buf, encodeCompactArrayLen(len(l.WritableIndexes))...)
+		buf = append(buf, l.WritableIndexes...)
+		buf = append(buf, encodeCompactArrayLen(len(l.ReadonlyIndexes))...)
+		buf = append(buf, l.ReadonlyIndexes...)
+	}
+	return buf
+}
+
+// Marshal serializes the versioned transaction: signatures followed by the
+// version-prefixed message.
+func (t *TransactionV0) Marshal() []byte {
+	var buf []byte
+	buf = append(buf, encodeCompactArrayLen(len(t.Signatures))...)
+	for _, s := range t.Signatures {
+		buf = append(buf, s[:]...)
+	}
+	buf = append(buf, t.Message.Marshal()...)
+	return buf
+}
+
+// UnmarshalTransaction decodes either a legacy or v0 transaction by
+// peeking at the high bit of the first byte after the signatures, per the
+// versioned transaction format: a set high bit on that byte means it is a
+// version number rather than a legacy NumSignatures count.
+func UnmarshalTransaction(data []byte) (legacy *Transaction, v0 *TransactionV0, err error) {
+	sigCount, rest, err := decodeCompactArrayLen(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	sigs := make([]Signature, sigCount)
+	for i := range sigs {
+		if len(rest) < ed25519.SignatureSize {
+			return nil, nil, errors.New("truncated signature")
+		}
+		copy(sigs[i][:], rest[:ed25519.SignatureSize])
+		rest = rest[ed25519.SignatureSize:]
+	}
+
+	if len(rest) == 0 {
+		return nil, nil, errors.New("truncated message")
+	}
+
+	if rest[0]&v0MessageVersionByte != 0 {
+		m, err := unmarshalMessageV0(rest[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &TransactionV0{Signatures: sigs, Message: m}, nil
+	}
+
+	m, err := unmarshalMessage(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Transaction{Signatures: sigs, Message: m}, nil, nil
+}
+
+// unmarshalMessage decodes a legacy (unversioned) Message, mirroring the
+// fields Message.Marshal writes: header, accounts, blockhash, then
+// instructions. It has no address table lookup section.
+func unmarshalMessage(data []byte) (Message, error) {
+	var m Message
+	if len(data) < 3 {
+		return m, errors.New("truncated message header")
+	}
+	m.Header = Header{data[0], data[1], data[2]}
+	data = data[3:]
+
+	accCount, data, err := decodeCompactArrayLen(data)
+	if err != nil {
+		return m, err
+	}
+	for i := 0; i < accCount; i++ {
+		if len(data) < ed25519.PublicKeySize {
+			return m, errors.New("truncated account key")
+		}
+		m.Accounts = append(m.Accounts, ed25519.PublicKey(data[:ed25519.PublicKeySize]))
+		data = data[ed25519.PublicKeySize:]
+	}
+
+	if len(data) < len(m.RecentBlockhash) {
+		return m, errors.New("truncated blockhash")
+	}
+	copy(m.RecentBlockhash[:], data[:len(m.RecentBlockhash)])
+	data = data[len(m.RecentBlockhash):]
+
+	insCount, data, err := decodeCompactArrayLen(data)
+	if err != nil {
+		return m, err
+	}
+	for i := 0; i < insCount; i++ {
+		if len(data) < 1 {
+			return m, errors.New("truncated instruction")
+		}
+		ci := CompiledInstruction{ProgramIndex: data[0]}
+		data = data[1:]
+
+		accIdxCount, rest, err := decodeCompactArrayLen(data)
+		if err != nil {
+			return m, err
+		}
+		if len(rest) < accIdxCount {
+			return m, errors.New("truncated instruction accounts")
+		}
+		ci.Accounts = append(ci.Accounts, rest[:accIdxCount]...)
+		data = rest[accIdxCount:]
+
+		dataLen, rest2, err := decodeCompactArrayLen(data)
+		if err != nil {
+			return m, err
+		}
+		if len(rest2) < dataLen {
+			return m, errors.New("truncated instruction data")
+		}
+		ci.Data = append(ci.Data, rest2[:dataLen]...)
+		data = rest2[dataLen:]
+
+		m.Instructions = append(m.Instructions, ci)
+	}
+
+	return m, nil
+}
+
+func unmarshalMessageV0(data []byte) (MessageV0, error) {
+	var m MessageV0
+	if len(data) < 3 {
+		return m, errors.New("truncated message header")
+	}
+	m.Header = Header{data[0], data[1], data[2]}
+	data = data[3:]
+
+	accCount, data, err := decodeCompactArrayLen(data)
+	if err != nil {
+		return m, err
+	}
+	for i := 0; i < accCount; i++ {
+		if len(data) < ed25519.PublicKeySize {
+			return m, errors.New("truncated account key")
+		}
+		m.Accounts = append(m.Accounts, ed25519.PublicKey(data[:ed25519.PublicKeySize]))
+		data = data[ed25519.PublicKeySize:]
+	}
+
+	if len(data) < len(m.RecentBlockhash) {
+		return m, errors.New("truncated blockhash")
+	}
+	copy(m.RecentBlockhash[:], data[:len(m.RecentBlockhash)])
+	data = data[len(m.RecentBlockhash):]
+
+	insCount, data, err := decodeCompactArrayLen(data)
+	if err != nil {
+		return m, err
+	}
+	for i := 0; i < insCount; i++ {
+		if len(data) < 1 {
+			return m, errors.New("truncated instruction")
+		}
+		ci := CompiledInstruction{ProgramIndex: data[0]}
+		data = data[1:]
+
+		accIdxCount, rest, err := decodeCompactArrayLen(data)
+		if err != nil {
+			return m, err
+		}
+		if len(rest) < accIdxCount {
+			return m, errors.New("truncated instruction accounts")
+		}
+		ci.Accounts = append(ci.Accounts, rest[:accIdxCount]...)
+		data = rest[accIdxCount:]
+
+		dataLen, rest2, err := decodeCompactArrayLen(data)
+		if err != nil {
+			return m, err
+		}
+		if len(rest2) < dataLen {
+			return m, errors.New("truncated instruction data")
+		}
+		ci.Data = append(ci.Data, rest2[:dataLen]...)
+		data = rest2[dataLen:]
+
+		m.Instructions = append(m.Instructions, ci)
+	}
+
+	lutCount, data, err := decodeCompactArrayLen(data)
+	if err != nil {
+		return m, err
+	}
+	for i := 0; i < lutCount; i++ {
+		if len(data) < ed25519.PublicKeySize {
+			return m, errors.New("truncated lookup table key")
+		}
+		lut := MessageAddressTableLookup{AccountKey: ed25519.PublicKey(data[:ed25519.PublicKeySize])}
+		data = data[ed25519.PublicKeySize:]
+
+		wCount, rest, err := decodeCompactArrayLen(data)
+		if err != nil {
+			return m, err
+		}
+		if len(rest) < wCount {
+			return m, errors.New("truncated writable indexes")
+		}
+		lut.WritableIndexes = append(lut.WritableIndexes, rest[:wCount]...)
+		data = rest[wCount:]
+
+		rCount, rest2, err := decodeCompactArrayLen(data)
+		if err != nil {
+			return m, err
+		}
+		if len(rest2) < rCount {
+			return m, errors.New("truncated readonly indexes")
+		}
+		lut.ReadonlyIndexes = append(lut.ReadonlyIndexes, rest2[:rCount]...)
+		data = rest2[rCount:]
+
+		m.AddressTableLookups = append(m.AddressTableLookups, lut)
+	}
+
+	return m, nil
+}
+
+func encodeCompactArrayLen(n int) []byte {
+	// Solana's "compact-u16" varint: 7 bits per byte, high bit set on all
+	// but the last byte.
+	var buf []byte
+	v := uint(n)
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			buf = append(buf, b|0x80)
+		} else {
+			buf = append(buf, b)
+			break
+		}
+	}
+	return buf
+}
+
+func decodeCompactArrayLen(data []byte) (int, []byte, error) {
+	var n uint
+	var shift uint
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		n |= uint(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return int(n), data[i+1:], nil
+		}
+		shift += 7
+	}
+	return 0, nil, errors.New("truncated compact array length")
+}
@@ -0,0 +1,53 @@
+package solana
+
+import (
+	"crypto/ed25519"
+
+	"wallet-srv/lib/pkg/solana/base58"
+)
+
+// systemProgram is the well-known address of Solana's SystemProgram, the
+// owner of nonce accounts and the target of AdvanceNonceAccount.
+var systemProgram = mustDecodeAddress("11111111111111111111111111111111")
+
+// advanceNonceAccountInstructionIndex is the SystemInstruction enum value
+// for AdvanceNonceAccount.
+const advanceNonceAccountInstructionIndex uint32 = 4
+
+// NewDurableNonceTransaction builds a transaction whose validity does not
+// depend on a recent blockhash. It prepends the SystemProgram
+// AdvanceNonceAccount instruction, which both authorizes the transaction
+// (via nonceAuthority) and advances the on-chain nonce so it cannot be
+// replayed. The caller must set the transaction's blockhash field to the
+// nonce account's current stored value, via SetBlockhash, before signing:
+// durable-nonce transactions use that field to carry the nonce value
+// instead of an actual recent blockhash.
+func NewDurableNonceTransaction(nonceAccount, nonceAuthority ed25519.PublicKey, instructions ...Instruction) Transaction {
+	advance := Instruction{
+		Program: systemProgram,
+		Accounts: []AccountMeta{
+			{PublicKey: nonceAccount, IsWritable: true},
+			{PublicKey: recentBlockhashesSysvar},
+			{PublicKey: nonceAuthority, IsSigner: true},
+		},
+		Data: uint32ToLEBytes(advanceNonceAccountInstructionIndex),
+	}
+
+	all := make([]Instruction, 0, len(instructions)+1)
+	all = append(all, advance)
+	all = append(all, instructions...)
+
+	return NewTransaction(nonceAuthority, all...)
+}
+
+// recentBlockhashesSysvar is the sysvar account AdvanceNonceAccount reads
+// the current cluster blockhash from.
+var recentBlockhashesSysvar = mustDecodeAddress("SysvarRecentB1ockHashes11111111111111111111")
+
+func uint32ToLEBytes(v uint32) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+func mustDecodeAddress(s string) ed25519.PublicKey {
+	return ed25519.PublicKey(base58.Decode(s))
+}
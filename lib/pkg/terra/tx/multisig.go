@@ -0,0 +1,141 @@
+package tx
+
+import (
+	"errors"
+	"fmt"
+
+	cryptotypes "github.com/cosmos/cosmos-sdk/crypto/types"
+	"github.com/cosmos/cosmos-sdk/crypto/types/multisig"
+	"github.com/cosmos/cosmos-sdk/types/tx/signing"
+	authsigning "github.com/cosmos/cosmos-sdk/x/auth/signing"
+
+	"github.com/cosmos/cosmos-sdk/client"
+)
+
+var errUnsupportedPartialSignatureData = errors.New("partial signature must carry SingleSignatureData")
+
+// CosignerKey pairs a cosigner's private key with its index within the
+// multisig's PubKeys, so partial signatures can be placed correctly in
+// the aggregated bitarray.
+type CosignerKey struct {
+	PrivKey  PrivKey
+	SubIndex int
+}
+
+// PartialSign produces a single cosigner's signature over signerData
+// without touching txBuilder's signature list, so it can be collected
+// offline (e.g. from a hardware wallet) and combined later with
+// CombineSignatures or MultisigSign.
+func (txBuilder Builder) PartialSign(
+	signMode signing.SignMode, signerData SignerData, privKey PrivKey) (signing.SignatureV2, error) {
+
+	return SignWithPrivKey(
+		signing.SignMode(signMode),
+		authsigning.SignerData(signerData),
+		client.TxBuilder(txBuilder.TxBuilder),
+		cryptotypes.PrivKey(privKey),
+		client.TxConfig(txBuilder.TxConfig),
+		signerData.Sequence,
+	)
+}
+
+// PartialSignature pairs a cosigner's independently produced signature with
+// the SubIndex of the CosignerKey that produced it, so CombineSignatures
+// can place it at that exact position in the multisig's bitarray instead
+// of inferring a position from the signature's public key alone.
+type PartialSignature struct {
+	SubIndex  int
+	Signature signing.SignatureV2
+}
+
+// CombineSignatures aggregates independently produced cosigner signatures
+// into a single MultiSignatureData signature for pubKey, setting the bit
+// for each cosigner's SubIndex in the resulting bitarray. It's an error for
+// a partial's SubIndex not to match the public key pubKey actually has at
+// that position, which catches a cosigner set built in the wrong order
+// before it produces an unverifiable aggregate signature.
+func CombineSignatures(pubKey multisig.PubKey, partials []PartialSignature) (signing.SignatureV2, error) {
+	pubKeys := pubKey.GetPubKeys()
+	multisigData := multisig.NewMultisig(len(pubKeys))
+
+	for _, partial := range partials {
+		if _, ok := partial.Signature.Data.(*signing.SingleSignatureData); !ok {
+			return signing.SignatureV2{}, errUnsupportedPartialSignatureData
+		}
+		if partial.SubIndex < 0 || partial.SubIndex >= len(pubKeys) {
+			return signing.SignatureV2{}, fmt.Errorf("cosigner sub-index %d is out of range for a %d-key multisig", partial.SubIndex, len(pubKeys))
+		}
+		if !pubKeys[partial.SubIndex].Equals(partial.Signature.PubKey) {
+			return signing.SignatureV2{}, fmt.Errorf("cosigner sub-index %d does not match the signing public key", partial.SubIndex)
+		}
+		if err := multisig.AddSignatureV2(multisigData, partial.Signature, pubKeys); err != nil {
+			return signing.SignatureV2{}, err
+		}
+	}
+
+	return signing.SignatureV2{
+		PubKey: pubKey,
+		Data:   multisigData,
+	}, nil
+}
+
+// MultisigSign signs signerData once per entry in cosigners and aggregates
+// the resulting signatures into a MultiSignatureData for pubKey, then
+// calls SetSignatures with the aggregated result the same way Sign does
+// for a single-key signer.
+func (txBuilder Builder) MultisigSign(
+	signMode signing.SignMode, signerData SignerData,
+	pubKey *multisig.LegacyAminoPubKey, cosigners []CosignerKey, overwriteSig bool) error {
+
+	sigData := signing.SingleSignatureData{
+		SignMode:  signMode,
+		Signature: nil,
+	}
+	placeholder := signing.SignatureV2{
+		PubKey:   pubKey,
+		Data:     &sigData,
+		Sequence: signerData.Sequence,
+	}
+
+	var err error
+	var prevSignatures []signing.SignatureV2
+	if !overwriteSig {
+		prevSignatures, err = txBuilder.GetTx().GetSignaturesV2()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep every other signer's SignerInfo in place while the placeholder
+	// stands in for this multisig signer: cosigners below sign over
+	// signerData by way of the tx currently held in txBuilder, so dropping
+	// prevSignatures here would make them sign an AuthInfo that omits the
+	// other signers and produce a signature the real tx can't verify.
+	if err := txBuilder.SetSignatures(append(prevSignatures, placeholder)...); err != nil {
+		return err
+	}
+
+	partials := make([]PartialSignature, 0, len(cosigners))
+	for _, cosigner := range cosigners {
+		partial, err := SignWithPrivKey(
+			signing.SignMode(signMode),
+			authsigning.SignerData(signerData),
+			client.TxBuilder(txBuilder.TxBuilder),
+			cryptotypes.PrivKey(cosigner.PrivKey),
+			client.TxConfig(txBuilder.TxConfig),
+			signerData.Sequence,
+		)
+		if err != nil {
+			return err
+		}
+		partials = append(partials, PartialSignature{SubIndex: cosigner.SubIndex, Signature: partial})
+	}
+
+	aggregated, err := CombineSignatures(pubKey, partials)
+	if err != nil {
+		return err
+	}
+	aggregated.Sequence = signerData.Sequence
+
+	return txBuilder.SetSignatures(append(prevSignatures, aggregated)...)
+}
@@ -0,0 +1,298 @@
+package btc
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"sort"
+
+	"wallet-srv/lib/pkg/btc/txauthor"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+)
+
+// maxBnBTries bounds how many combinations BranchAndBound will explore
+// before giving up and falling back to a single-random-draw selection.
+const maxBnBTries = 100000
+
+// CoinSelector picks the subset of unspents to use as inputs for a
+// transaction that needs to pay target plus fees at feeRate. changeCost is
+// the additional fee (in satoshis) incurred by adding a change output,
+// used to decide whether an exact, changeless match is worth searching for.
+type CoinSelector interface {
+	Select(unspents []BtcUnspent, target btcutil.Amount, feeRate btcutil.Amount, changeCost btcutil.Amount) ([]BtcUnspent, error)
+}
+
+// LargestFirst selects unspents from largest to smallest amount until the
+// target is met. It is the default selector of
+// NewBtcTransactionWithSelector; NewBtcTransaction itself does not sort and
+// spends unspents in the order given.
+type LargestFirst struct{}
+
+func (LargestFirst) Select(unspents []BtcUnspent, target btcutil.Amount, feeRate btcutil.Amount, changeCost btcutil.Amount) ([]BtcUnspent, error) {
+	sorted := sortedByAmount(unspents, true)
+	return selectUntilTarget(sorted, target)
+}
+
+// SmallestFirst selects unspents from smallest to largest amount until the
+// target is met. Preferring small UTXOs first consolidates dust over time
+// at the cost of a larger, more expensive input set for any single spend.
+type SmallestFirst struct{}
+
+func (SmallestFirst) Select(unspents []BtcUnspent, target btcutil.Amount, feeRate btcutil.Amount, changeCost btcutil.Amount) ([]BtcUnspent, error) {
+	sorted := sortedByAmount(unspents, false)
+	return selectUntilTarget(sorted, target)
+}
+
+// BranchAndBound performs a depth-first search, as described in
+// https://murch.one/erhardt2016coinselection.pdf, over unspents sorted by
+// descending effective value (amount minus the fee to spend it at
+// feeRate), looking for a changeless match: a raw-amount sum in
+// [target, target+changeCost] that avoids creating a change output.
+// Effective value only orders and bounds the search; the match itself
+// compares against raw amounts, since target (as computed by the caller)
+// already has the selected inputs' fees baked in. If no such match is
+// found within maxBnBTries attempts, it falls back to SingleRandomDraw.
+type BranchAndBound struct{}
+
+func (BranchAndBound) Select(unspents []BtcUnspent, target btcutil.Amount, feeRate btcutil.Amount, changeCost btcutil.Amount) ([]BtcUnspent, error) {
+	type candidate struct {
+		unspent      BtcUnspent
+		amount       btcutil.Amount
+		effectiveVal btcutil.Amount
+	}
+
+	candidates := make([]candidate, 0, len(unspents))
+	for _, u := range unspents {
+		amount, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			continue
+		}
+		fee := feeRate * btcutil.Amount(estimateInputVSize(u)) / 1000
+		effVal := amount - fee
+		if effVal <= 0 {
+			// Not worth spending at this fee rate.
+			continue
+		}
+		candidates = append(candidates, candidate{u, amount, effVal})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].effectiveVal > candidates[j].effectiveVal
+	})
+
+	upperBound := target + changeCost
+
+	var best []BtcUnspent
+	tries := 0
+
+	// search tracks two running totals: effSum (the sum of effective
+	// values, i.e. with each input's own spending fee already deducted)
+	// orders and bounds the DFS, while rawSum (the sum of raw amounts) is
+	// what's actually compared against target: target, as txauthor
+	// computes it, already includes the fee for the inputs being
+	// selected, so it's in the same raw-amount space as rawSum, not
+	// effSum. Comparing a fee-discounted sum against a fee-inclusive
+	// target would double-count every selected input's fee and make a
+	// changeless match effectively unreachable.
+	var search func(idx int, selected []BtcUnspent, effSum, rawSum btcutil.Amount) bool
+	search = func(idx int, selected []BtcUnspent, effSum, rawSum btcutil.Amount) bool {
+		tries++
+		if tries > maxBnBTries {
+			return false
+		}
+		// A changeless match doesn't need exact equality: any rawSum
+		// that covers target while overshooting by no more than
+		// changeCost is cheaper than adding a change output, so accept
+		// the whole [target, target+changeCost] window.
+		if rawSum >= target && rawSum <= upperBound {
+			best = append([]BtcUnspent(nil), selected...)
+			return true
+		}
+		// effSum <= rawSum always (fees are non-negative), so pruning on
+		// effSum here never discards a branch that could still land
+		// rawSum back in the window.
+		if effSum > upperBound || idx >= len(candidates) {
+			return false
+		}
+
+		// Branch 1: include candidates[idx].
+		if search(idx+1, append(selected, candidates[idx].unspent), effSum+candidates[idx].effectiveVal, rawSum+candidates[idx].amount) {
+			return true
+		}
+		// Branch 2: exclude candidates[idx].
+		return search(idx+1, selected, effSum, rawSum)
+	}
+
+	if search(0, nil, 0, 0) {
+		return best, nil
+	}
+
+	return SingleRandomDraw{}.Select(unspents, target, feeRate, changeCost)
+}
+
+// SingleRandomDraw selects unspents in random order until the target is
+// met. It is used as the fallback when BranchAndBound cannot find a
+// changeless match, matching the approach Bitcoin Core takes when B&B fails.
+type SingleRandomDraw struct{}
+
+func (SingleRandomDraw) Select(unspents []BtcUnspent, target btcutil.Amount, feeRate btcutil.Amount, changeCost btcutil.Amount) ([]BtcUnspent, error) {
+	shuffled := make([]BtcUnspent, len(unspents))
+	copy(shuffled, unspents)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return selectUntilTarget(shuffled, target)
+}
+
+func sortedByAmount(unspents []BtcUnspent, descending bool) []BtcUnspent {
+	sorted := make([]BtcUnspent, len(unspents))
+	copy(sorted, unspents)
+	sort.Slice(sorted, func(i, j int) bool {
+		if descending {
+			return sorted[i].Amount > sorted[j].Amount
+		}
+		return sorted[i].Amount < sorted[j].Amount
+	})
+	return sorted
+}
+
+func selectUntilTarget(unspents []BtcUnspent, target btcutil.Amount) ([]BtcUnspent, error) {
+	var sum btcutil.Amount
+	selected := make([]BtcUnspent, 0, len(unspents))
+	for _, u := range unspents {
+		if sum >= target {
+			break
+		}
+		amount, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			continue
+		}
+		sum += amount
+		selected = append(selected, u)
+	}
+	if sum < target {
+		return nil, errors.New("insufficient funds to reach target")
+	}
+	return selected, nil
+}
+
+// estimateInputVSize differentiates P2PKH, P2WPKH and nested-P2WPKH inputs
+// by the shape of their scriptPubKey, since that's all a BtcUnspent
+// carries about the output being spent.
+func estimateInputVSize(u BtcUnspent) int {
+	script, err := hex.DecodeString(u.ScriptPubKey)
+	if err != nil || len(script) == 0 {
+		return redeemP2PKHInputSize
+	}
+	switch {
+	case len(script) == 22 && script[0] == 0x00 && script[1] == 0x14:
+		// P2WPKH: witness-only input.
+		return redeemP2WPKHInputSize
+	case len(script) == 23 && script[0] == 0xa9 && script[len(script)-1] == 0x87:
+		// P2SH, assumed nested-P2WPKH since that's the only kind this
+		// wallet produces as a change/receive address.
+		return redeemNestedP2WPKHInputSize
+	default:
+		return redeemP2PKHInputSize
+	}
+}
+
+const (
+	redeemP2PKHInputSize        = 148
+	redeemP2WPKHInputSize       = 68
+	redeemNestedP2WPKHInputSize = 91
+)
+
+// makeInputSourceWithSelector builds a txauthor.InputSource that delegates
+// the choice of which unspents to spend to selector, re-running selection
+// as the target amount is refined during fee estimation. It also returns
+// an accessor for the unspents chosen on the most recent call.
+func makeInputSourceWithSelector(unspents []BtcUnspent, selector CoinSelector, feeRate btcutil.Amount, changeCost btcutil.Amount) (txauthor.InputSource, func() []BtcUnspent) {
+	var used []BtcUnspent
+
+	source := func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, []btcutil.Amount, [][]byte, error) {
+		selected, err := selector.Select(unspents, target, feeRate, changeCost)
+		if err != nil {
+			return 0, nil, nil, nil, err
+		}
+		used = selected
+
+		var total btcutil.Amount
+		ins := make([]*wire.TxIn, 0, len(selected))
+		vals := make([]btcutil.Amount, 0, len(selected))
+		scripts := make([][]byte, 0, len(selected))
+		for _, u := range selected {
+			hash, _ := chainhash.NewHashFromStr(u.TxID)
+			ins = append(ins, wire.NewTxIn(&wire.OutPoint{
+				Hash:  *hash,
+				Index: u.Vout,
+			}, nil, nil))
+
+			amount, _ := btcutil.NewAmount(u.Amount)
+			s, _ := hex.DecodeString(u.ScriptPubKey)
+
+			total += amount
+			vals = append(vals, amount)
+			scripts = append(scripts, s)
+		}
+		return total, ins, vals, scripts, nil
+	}
+
+	return source, func() []BtcUnspent { return used }
+}
+
+// NewBtcTransactionWithSelector is identical to NewBtcTransaction except
+// that the set of inputs is chosen by selector (LargestFirst when selector
+// is nil) instead of being taken in the order given, allowing callers to opt into fee-aware selection
+// strategies such as BranchAndBound.
+func NewBtcTransactionWithSelector(unspents []BtcUnspent, outputs []BtcOutput, changeAddress btcutil.Address,
+	feePerKb int64, chainCfg *chaincfg.Params, selector CoinSelector) (*BtcTransaction, error) {
+
+	if len(unspents) == 0 || changeAddress == nil || feePerKb <= 0 {
+		return nil, errors.New("wrong params")
+	}
+	if selector == nil {
+		selector = LargestFirst{}
+	}
+
+	if !changeAddress.IsForNet(chainCfg) {
+		return nil, errors.New("change address is not the corresponding network address")
+	}
+
+	changeBytes, err := txscript.PayToAddrScript(changeAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	feeRatePerKb := btcutil.Amount(feePerKb)
+
+	txOuts, err := makeTxOutputs(outputs, feeRatePerKb, chainCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	changeSource := txauthor.ChangeSource{
+		NewScript: func() ([]byte, error) {
+			return changeBytes, nil
+		},
+		ScriptSize: len(changeBytes),
+	}
+	changeCost := FeeForSerializeSize(feeRatePerKb, changeSource.ScriptSize+txsizes.P2WPKHOutputSize-txsizes.P2WPKHPkScriptSize)
+
+	inputSource, usedUnspents := makeInputSourceWithSelector(unspents, selector, feeRatePerKb, changeCost)
+
+	unsignedTx, err := txauthor.NewUnsignedTransaction(txOuts, feeRatePerKb, inputSource, &changeSource)
+	if err != nil {
+		return nil, err
+	}
+	if unsignedTx.ChangeIndex >= 0 {
+		unsignedTx.RandomizeChangePosition()
+	}
+
+	return &BtcTransaction{*unsignedTx, chainCfg, feePerKb, usedUnspents()}, nil
+}
@@ -0,0 +1,125 @@
+package btc
+
+import (
+	"errors"
+	"fmt"
+
+	"wallet-srv/lib/pkg/btc/txauthor"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcec"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+// HDSecretsSource is a txauthor.SecretsSource that derives each input's
+// private key on demand from an extended private key plus a BIP-32
+// derivation path, instead of requiring the caller to pre-load every key
+// into a wallet.BtcWallet. It's meant for cold-storage signing flows where
+// the transaction (and its per-input DerivationInfo) were produced by a
+// separate watch-only process.
+type HDSecretsSource struct {
+	masterKey   *hdkeychain.ExtendedKey
+	chainParams *chaincfg.Params
+	// paths maps each input index to the path used to derive its key,
+	// populated from BtcTransaction.DerivationPaths() by NewHDSecretsSource.
+	paths map[int][]uint32
+}
+
+// NewHDSecretsSource builds an HDSecretsSource for signing tx, deriving
+// keys from xprv for every input that carries derivation metadata (see
+// BtcUnspent.DerivationPath).
+func NewHDSecretsSource(xprv string, chainCfg *chaincfg.Params, tx *BtcTransaction) (*HDSecretsSource, error) {
+	masterKey, err := hdkeychain.NewKeyFromString(xprv)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse extended private key: %s", err)
+	}
+	if !masterKey.IsPrivate() {
+		return nil, errors.New("extended key is not a private key")
+	}
+
+	paths := make(map[int][]uint32, len(tx.unspents))
+	for _, info := range tx.DerivationPaths() {
+		paths[info.InputIndex] = info.DerivationPath
+	}
+
+	return &HDSecretsSource{
+		masterKey:   masterKey,
+		chainParams: chainCfg,
+		paths:       paths,
+	}, nil
+}
+
+// ChainParams implements txauthor.SecretsSource.
+func (s *HDSecretsSource) ChainParams() *chaincfg.Params {
+	return s.chainParams
+}
+
+// GetKey implements txauthor.SecretsSource by deriving the private key for
+// addr from the master extended key. Since txauthor.SecretsSource is keyed
+// by address rather than input index, it tries every recorded derivation
+// path and returns the key whose address (of the same type as addr)
+// matches addr.
+func (s *HDSecretsSource) GetKey(addr btcutil.Address) (*btcec.PrivateKey, bool, error) {
+	for _, path := range s.paths {
+		key, err := deriveChildKey(s.masterKey, path)
+		if err != nil {
+			continue
+		}
+		privKey, err := key.ECPrivKey()
+		if err != nil {
+			continue
+		}
+		derivedAddr, err := addressForPrivKey(privKey, addr, s.chainParams)
+		if err != nil {
+			continue
+		}
+		if derivedAddr.EncodeAddress() == addr.EncodeAddress() {
+			return privKey, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("no known derivation path produces address %s", addr.EncodeAddress())
+}
+
+// GetScript implements txauthor.SecretsSource. HDSecretsSource doesn't
+// carry redeem scripts on its own; callers spending P2SH inputs should
+// keep using a wallet.BtcWallet or set BtcUnspent.RedeemScript so it ends
+// up in the PSBT, since a bare xprv has no way to recover it.
+func (s *HDSecretsSource) GetScript(addr btcutil.Address) ([]byte, error) {
+	return nil, fmt.Errorf("no redeem script known for address %s", addr.EncodeAddress())
+}
+
+func deriveChildKey(master *hdkeychain.ExtendedKey, path []uint32) (*hdkeychain.ExtendedKey, error) {
+	key := master
+	for _, index := range path {
+		child, err := key.Derive(index)
+		if err != nil {
+			return nil, err
+		}
+		key = child
+	}
+	return key, nil
+}
+
+func addressForPrivKey(privKey *btcec.PrivateKey, want btcutil.Address, chainCfg *chaincfg.Params) (btcutil.Address, error) {
+	pubKey := privKey.PubKey()
+	switch want.(type) {
+	case *btcutil.AddressWitnessPubKeyHash:
+		return btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), chainCfg)
+	case *btcutil.AddressScriptHash:
+		wpkh, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), chainCfg)
+		if err != nil {
+			return nil, err
+		}
+		redeemScript, err := txscript.PayToAddrScript(wpkh)
+		if err != nil {
+			return nil, err
+		}
+		return btcutil.NewAddressScriptHash(redeemScript, chainCfg)
+	default:
+		return btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), chainCfg)
+	}
+}
+
+var _ txauthor.SecretsSource = (*HDSecretsSource)(nil)
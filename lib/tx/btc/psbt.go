@@ -0,0 +1,363 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"wallet-srv/lib/pkg/btc/txauthor"
+	"wallet-srv/lib/wallet"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+)
+
+// PsbtGlobal mirrors the PSBT global map fields we care about when
+// constructing a packet for an external signer.
+type PsbtGlobal struct {
+	UnsignedTx *wire.MsgTx
+	Version    uint32
+}
+
+// ToPSBT serializes t into a Partially Signed Bitcoin Transaction, filling
+// in the per-input witness/non-witness UTXOs, redeem scripts for nested
+// P2WPKH inputs, and BIP-32 derivation paths looked up from w for each
+// input's BtcUnspent.Address. The returned bytes are the raw (non-base64)
+// PSBT encoding.
+func (t *BtcTransaction) ToPSBT(w *wallet.BtcWallet) ([]byte, error) {
+	if len(t.unspents) != len(t.Tx.TxIn) {
+		return nil, errors.New("missing unspent metadata for one or more inputs")
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(t.Tx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create psbt from unsigned tx: %s", err)
+	}
+
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create psbt updater: %s", err)
+	}
+
+	for i, u := range t.unspents {
+		prevScript, err := hexDecodeScript(u.ScriptPubKey)
+		if err != nil {
+			return nil, err
+		}
+		amount, _ := btcutil.NewAmount(u.Amount)
+
+		// Resolve the redeem script first (it's what tells P2SH inputs
+		// apart: nested-P2WPKH wraps a witness program and only needs a
+		// WitnessUtxo, while a legacy P2SH input needs the full
+		// NonWitnessUtxo).
+		var redeemScript []byte
+		if u.RedeemScript != "" {
+			redeemScript, err = hexDecodeScript(u.RedeemScript)
+			if err != nil {
+				return nil, err
+			}
+		} else if txscript.IsPayToScriptHash(prevScript) {
+			redeemScript, _, err = nestedWitnessRedeemScript(w, u.Address, t.chainParams)
+			if err != nil {
+				return nil, err
+			}
+		}
+		isNestedWitness := len(redeemScript) > 0 &&
+			(txscript.IsPayToWitnessPubKeyHash(redeemScript) || txscript.IsPayToWitnessScriptHash(redeemScript))
+
+		if txscript.IsPayToWitnessPubKeyHash(prevScript) || txscript.IsPayToWitnessScriptHash(prevScript) || isNestedWitness {
+			if err := updater.AddInWitnessUtxo(&wire.TxOut{Value: int64(amount), PkScript: prevScript}, i); err != nil {
+				return nil, fmt.Errorf("cannot add witness utxo for input %d: %s", i, err)
+			}
+		} else {
+			prevTx, err := t.fetchPrevTx(u)
+			if err != nil {
+				return nil, err
+			}
+			if err := updater.AddInNonWitnessUtxo(prevTx, i); err != nil {
+				return nil, fmt.Errorf("cannot add non-witness utxo for input %d: %s", i, err)
+			}
+		}
+
+		if len(redeemScript) > 0 {
+			if err := updater.AddInRedeemScript(redeemScript, i); err != nil {
+				return nil, fmt.Errorf("cannot add redeem script for input %d: %s", i, err)
+			}
+		}
+
+		// AddInBip32Derivation needs the actual public key, which an
+		// address alone doesn't give us; when the wallet's key manager
+		// can resolve it, embed it in the PSBT. A BtcUnspent that only
+		// carries a static DerivationPath (no local wallet to consult)
+		// still has that metadata available via DerivationPaths().
+		if w != nil {
+			pubKey, fingerprint, path, err := lookupDerivationInfo(w, u.Address, t.chainParams)
+			if err == nil && pubKey != nil {
+				if err := updater.AddInBip32Derivation(fingerprint, path, pubKey, i); err != nil {
+					return nil, fmt.Errorf("cannot add bip32 derivation for input %d: %s", i, err)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := packet.Serialize(&buf); err != nil {
+		return nil, fmt.Errorf("cannot serialize psbt: %s", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// NewBtcTransactionFromPSBT rehydrates a BtcTransaction from a raw PSBT, for
+// the watch-only workflow where the unsigned transaction originates
+// elsewhere (e.g. an external coordinator). Each input's BIP-32 derivation
+// field, when present, is carried over into the rehydrated BtcUnspent so
+// that an HDSecretsSource built from the result (via
+// BtcTransaction.DerivationPaths) can still derive the signing key, even
+// though no wallet.BtcWallet was involved in producing this tx.
+func NewBtcTransactionFromPSBT(raw []byte, chainCfg *chaincfg.Params, feePerKb int64) (*BtcTransaction, error) {
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(raw), false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse psbt: %s", err)
+	}
+
+	prevScripts := make([][]byte, len(packet.Inputs))
+	prevValues := make([]btcutil.Amount, len(packet.Inputs))
+	unspents := make([]BtcUnspent, len(packet.Inputs))
+	var totalInput btcutil.Amount
+	for i, in := range packet.Inputs {
+		var prevTxHex string
+		switch {
+		case in.WitnessUtxo != nil:
+			prevScripts[i] = in.WitnessUtxo.PkScript
+			prevValues[i] = btcutil.Amount(in.WitnessUtxo.Value)
+		case in.NonWitnessUtxo != nil:
+			vout := packet.UnsignedTx.TxIn[i].PreviousOutPoint.Index
+			out := in.NonWitnessUtxo.TxOut[vout]
+			prevScripts[i] = out.PkScript
+			prevValues[i] = btcutil.Amount(out.Value)
+			var prevTxBuf bytes.Buffer
+			if err := in.NonWitnessUtxo.Serialize(&prevTxBuf); err == nil {
+				prevTxHex = hex.EncodeToString(prevTxBuf.Bytes())
+			}
+		default:
+			return nil, fmt.Errorf("psbt input %d has no witness or non-witness utxo", i)
+		}
+		totalInput += prevValues[i]
+
+		outPoint := packet.UnsignedTx.TxIn[i].PreviousOutPoint
+		u := BtcUnspent{
+			TxID:         outPoint.Hash.String(),
+			Vout:         outPoint.Index,
+			ScriptPubKey: hex.EncodeToString(prevScripts[i]),
+			Amount:       SatoshiToBtc(int64(prevValues[i])),
+			PrevTx:       prevTxHex,
+		}
+		if addr, err := scriptToAddress(prevScripts[i], chainCfg); err == nil {
+			u.Address = addr.String()
+		}
+		if in.RedeemScript != nil {
+			u.RedeemScript = hex.EncodeToString(in.RedeemScript)
+		}
+		if len(in.Bip32Derivation) > 0 {
+			deriv := in.Bip32Derivation[0]
+			binary.LittleEndian.PutUint32(u.MasterKeyFingerprint[:], deriv.MasterKeyFingerprint)
+			u.DerivationPath = append([]uint32(nil), deriv.Bip32Path...)
+		}
+		unspents[i] = u
+	}
+
+	authoredTx := txauthor.AuthoredTx{
+		Tx:              packet.UnsignedTx,
+		PrevScripts:     prevScripts,
+		PrevInputValues: prevValues,
+		TotalInput:      totalInput,
+		ChangeIndex:     -1,
+	}
+
+	return &BtcTransaction{authoredTx, chainCfg, feePerKb, unspents}, nil
+}
+
+// SignPSBT signs every input of psbt with keys and scripts from secrets,
+// without requiring the caller to have already reconstructed a
+// BtcTransaction for it (t only supplies the chain params and fee rate).
+// It fails if any input cannot be signed and validated, so the returned
+// PSBT carries final scripts for every input; partial signing is not
+// supported.
+func (t *BtcTransaction) SignPSBT(secrets txauthor.SecretsSource, raw []byte) ([]byte, error) {
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(raw), false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse psbt: %s", err)
+	}
+
+	signed, err := NewBtcTransactionFromPSBT(raw, t.chainParams, t.feePerKb)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := signed.SignWithSecretsSource(secrets); err != nil {
+		return nil, err
+	}
+
+	for i := range packet.Inputs {
+		packet.Inputs[i].FinalScriptSig = signed.Tx.TxIn[i].SignatureScript
+		if len(signed.Tx.TxIn[i].Witness) > 0 {
+			packet.Inputs[i].FinalScriptWitness = witnessBytes(signed.Tx.TxIn[i].Witness)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := packet.Serialize(&buf); err != nil {
+		return nil, fmt.Errorf("cannot serialize psbt: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// FinalizePSBT runs the standard PSBT finalizer over every input and, once
+// all inputs are final, extracts a ready-to-broadcast BtcTransaction.
+func FinalizePSBT(raw []byte, chainCfg *chaincfg.Params, feePerKb int64) (*BtcTransaction, error) {
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(raw), false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse psbt: %s", err)
+	}
+
+	complete, err := psbt.MaybeFinalizeAll(packet)
+	if err != nil {
+		return nil, fmt.Errorf("cannot finalize psbt: %s", err)
+	}
+	if !complete {
+		return nil, errors.New("psbt is not fully signed")
+	}
+
+	signedTx, err := psbt.Extract(packet)
+	if err != nil {
+		return nil, fmt.Errorf("cannot extract final transaction: %s", err)
+	}
+
+	authoredTx := txauthor.AuthoredTx{
+		Tx:          signedTx,
+		ChangeIndex: -1,
+	}
+	return &BtcTransaction{authoredTx, chainCfg, feePerKb, nil}, nil
+}
+
+func hexDecodeScript(s string) ([]byte, error) {
+	script, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode script %q: %s", s, err)
+	}
+	return script, nil
+}
+
+func witnessBytes(w wire.TxWitness) []byte {
+	var buf bytes.Buffer
+	wire.WriteVarInt(&buf, 0, uint64(len(w)))
+	for _, item := range w {
+		wire.WriteVarBytes(&buf, 0, item)
+	}
+	return buf.Bytes()
+}
+
+// fetchPrevTx decodes the full previous transaction for a legacy
+// (non-witness) input from u.PrevTx. This package has no node connection to
+// fetch it itself, so callers spending legacy P2PKH or non-nested P2SH
+// outputs must populate BtcUnspent.PrevTx up front; inputs backed by a
+// native or nested witness program don't need it at all.
+func (t *BtcTransaction) fetchPrevTx(u BtcUnspent) (*wire.MsgTx, error) {
+	if u.PrevTx == "" {
+		return nil, fmt.Errorf("non-witness utxo for %s:%d requires BtcUnspent.PrevTx to be set (legacy P2PKH/P2SH inputs aren't fetched automatically)", u.TxID, u.Vout)
+	}
+
+	raw, err := hex.DecodeString(u.PrevTx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode prev tx for %s:%d: %s", u.TxID, u.Vout, err)
+	}
+
+	var prevTx wire.MsgTx
+	if err := prevTx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("cannot parse prev tx for %s:%d: %s", u.TxID, u.Vout, err)
+	}
+	if prevTx.TxHash().String() != u.TxID {
+		return nil, fmt.Errorf("prev tx for %s:%d does not hash to the expected txid", u.TxID, u.Vout)
+	}
+
+	return &prevTx, nil
+}
+
+// nestedWitnessRedeemScript recovers the P2WPKH witness program a
+// nested-P2WPKH address's P2SH scriptPubKey wraps. The P2SH address itself
+// only carries a hash, not the pubkey the witness program is built from, so
+// this requires looking the address up in w; callers that can't supply a
+// wallet (e.g. signing from a bare PSBT) must set BtcUnspent.RedeemScript
+// instead, which ToPSBT prefers when present.
+func nestedWitnessRedeemScript(w *wallet.BtcWallet, address string, chainCfg *chaincfg.Params) ([]byte, bool, error) {
+	if w == nil {
+		return nil, false, nil
+	}
+
+	addr, err := DecodeAddress(address, chainCfg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	managedAddr, err := w.AddressInfo(addr)
+	if err != nil {
+		return nil, false, nil
+	}
+	pubKeyAddr, ok := managedAddr.(waddrmgr.ManagedPubKeyAddress)
+	if !ok {
+		return nil, false, nil
+	}
+
+	wpkhAddr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKeyAddr.PubKey().SerializeCompressed()), chainCfg)
+	if err != nil {
+		return nil, false, err
+	}
+	redeemScript, err := txscript.PayToAddrScript(wpkhAddr)
+	if err != nil {
+		return nil, false, err
+	}
+	return redeemScript, true, nil
+}
+
+func lookupDerivationInfo(w *wallet.BtcWallet, address string, chainCfg *chaincfg.Params) ([]byte, uint32, []uint32, error) {
+	addr, err := DecodeAddress(address, chainCfg)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	managedAddr, err := w.AddressInfo(addr)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	pubKeyAddr, ok := managedAddr.(waddrmgr.ManagedPubKeyAddress)
+	if !ok {
+		return nil, 0, nil, fmt.Errorf("address %s has no associated public key", address)
+	}
+
+	scope, derivationPath, ok := pubKeyAddr.DerivationInfo()
+	if !ok {
+		return nil, 0, nil, fmt.Errorf("address %s has no bip32 derivation info", address)
+	}
+
+	// The full path from the master key, not just the account-relative
+	// branch/index: deriveChildKey in hdsigner.go walks this from xprv
+	// directly, so it needs the hardened purpose/coin/account components
+	// too, not only the account-internal part waddrmgr tracks.
+	path := []uint32{
+		scope.Purpose + hdkeychain.HardenedKeyStart,
+		scope.Coin + hdkeychain.HardenedKeyStart,
+		derivationPath.InternalAccount + hdkeychain.HardenedKeyStart,
+		derivationPath.Branch,
+		derivationPath.Index,
+	}
+
+	return pubKeyAddr.PubKey().SerializeCompressed(), derivationPath.MasterKeyFingerprint, path, nil
+}
@@ -0,0 +1,271 @@
+package btc
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"wallet-srv/lib/wallet"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+)
+
+// rbfSequence is the sequence number used to opt a transaction into BIP-125
+// replace-by-fee signalling. Any sequence below 0xfffffffe is enough, but
+// 0xfffffffd is the value miners and wallets have converged on.
+const rbfSequence = 0xfffffffd
+
+// NewRBFBtcTransaction behaves exactly like NewBtcTransaction except that
+// every input's sequence number is set to signal BIP-125 replace-by-fee,
+// allowing the transaction to be fee-bumped with BumpFee before it
+// confirms.
+func NewRBFBtcTransaction(unspents []BtcUnspent, outputs []BtcOutput,
+	changeAddress btcutil.Address, feePerKb int64, chainCfg *chaincfg.Params) (*BtcTransaction, error) {
+
+	tx, err := NewBtcTransaction(unspents, outputs, changeAddress, feePerKb, chainCfg)
+	if err != nil {
+		return nil, err
+	}
+	markRBF(tx.Tx)
+	return tx, nil
+}
+
+func markRBF(msgTx *wire.MsgTx) {
+	for _, in := range msgTx.TxIn {
+		in.Sequence = rbfSequence
+	}
+}
+
+// NewRBFBtcTransactionWithSelector behaves exactly like
+// NewRBFBtcTransaction except that the set of inputs is chosen by selector,
+// as NewBtcTransactionWithSelector does.
+func NewRBFBtcTransactionWithSelector(unspents []BtcUnspent, outputs []BtcOutput, changeAddress btcutil.Address,
+	feePerKb int64, chainCfg *chaincfg.Params, selector CoinSelector) (*BtcTransaction, error) {
+
+	tx, err := NewBtcTransactionWithSelector(unspents, outputs, changeAddress, feePerKb, chainCfg, selector)
+	if err != nil {
+		return nil, err
+	}
+	markRBF(tx.Tx)
+	return tx, nil
+}
+
+// IsRBF reports whether t signals BIP-125 replace-by-fee.
+func (t *BtcTransaction) IsRBF() bool {
+	for _, in := range t.Tx.TxIn {
+		if in.Sequence < 0xfffffffe {
+			return true
+		}
+	}
+	return false
+}
+
+// BumpFee rebuilds t at newFeePerKb, keeping the same outputs and every one
+// of t's original inputs (BIP-125 requires a replacement to conflict with
+// the transaction it replaces, so dropping an original input would produce
+// an unrelated spend instead of a replacement). If the original inputs
+// cannot cover the higher fee, additional unspents from pool are pulled in
+// as extra inputs on top of them. The returned transaction is signed with
+// wallet and is a valid RBF replacement for t (same outputs, same
+// original inputs, strictly higher fee, signalling sequence numbers).
+func (t *BtcTransaction) BumpFee(newFeePerKb int64, pool []BtcUnspent, w *wallet.BtcWallet) (*BtcTransaction, error) {
+	if !t.IsRBF() {
+		return nil, errors.New("transaction does not signal replace-by-fee")
+	}
+	if newFeePerKb <= t.feePerKb {
+		return nil, errors.New("new fee rate must be higher than the current fee rate")
+	}
+	if len(t.unspents) == 0 {
+		return nil, errors.New("original transaction has no recorded inputs to rebuild from")
+	}
+
+	changeAddr, outputs, err := t.outputsForReplacement()
+	if err != nil {
+		return nil, err
+	}
+
+	unspents := append(append([]BtcUnspent(nil), t.unspents...), pool...)
+	selector := retainOriginalInputs{original: t.unspents}
+
+	replacement, err := NewRBFBtcTransactionWithSelector(unspents, outputs, changeAddr, newFeePerKb, t.chainParams, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	if replacement.GetFee() <= t.GetFee() {
+		return nil, errors.New("replacement transaction does not pay a strictly higher fee")
+	}
+
+	if err := replacement.Sign(w); err != nil {
+		return nil, err
+	}
+
+	return replacement, nil
+}
+
+// retainOriginalInputs is the CoinSelector BumpFee uses to rebuild a
+// replacement transaction: it always spends every one of original's inputs
+// (so the replacement conflicts with the transaction it bumps, as BIP-125
+// requires) and falls back to LargestFirst over whatever's left of
+// unspents to cover any additional amount the higher fee demands.
+type retainOriginalInputs struct {
+	original []BtcUnspent
+}
+
+func (s retainOriginalInputs) Select(unspents []BtcUnspent, target btcutil.Amount, feeRate btcutil.Amount, changeCost btcutil.Amount) ([]BtcUnspent, error) {
+	kept := append([]BtcUnspent(nil), s.original...)
+
+	var sum btcutil.Amount
+	for _, u := range kept {
+		amount, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			continue
+		}
+		sum += amount
+	}
+	if sum >= target {
+		return kept, nil
+	}
+
+	pool := excludeUnspents(unspents, s.original)
+	additional, err := LargestFirst{}.Select(pool, target-sum, feeRate, changeCost)
+	if err != nil {
+		return nil, err
+	}
+	return append(kept, additional...), nil
+}
+
+// excludeUnspents returns the entries of all that don't share an outpoint
+// (txid:vout) with exclude.
+func excludeUnspents(all, exclude []BtcUnspent) []BtcUnspent {
+	skip := make(map[string]struct{}, len(exclude))
+	for _, u := range exclude {
+		skip[outpointKey(u)] = struct{}{}
+	}
+
+	remaining := make([]BtcUnspent, 0, len(all))
+	for _, u := range all {
+		if _, ok := skip[outpointKey(u)]; ok {
+			continue
+		}
+		remaining = append(remaining, u)
+	}
+	return remaining
+}
+
+func outpointKey(u BtcUnspent) string {
+	return fmt.Sprintf("%s:%d", u.TxID, u.Vout)
+}
+
+// outputsForReplacement splits t's current outputs into the change address
+// (the one that will absorb the fee increase) and the payment outputs that
+// must be preserved verbatim by a replacement transaction.
+func (t *BtcTransaction) outputsForReplacement() (btcutil.Address, []BtcOutput, error) {
+	if !t.HasChange() {
+		return nil, nil, errors.New("transaction has no change output to bump fee from")
+	}
+
+	outputs := make([]BtcOutput, 0, len(t.Tx.TxOut)-1)
+	var changeAddr btcutil.Address
+	for i, out := range t.Tx.TxOut {
+		addr, err := scriptToAddress(out.PkScript, t.chainParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == t.ChangeIndex {
+			changeAddr = addr
+			continue
+		}
+		outputs = append(outputs, BtcOutput{Address: addr, Amount: out.Value})
+	}
+
+	return changeAddr, outputs, nil
+}
+
+func scriptToAddress(pkScript []byte, chainCfg *chaincfg.Params) (btcutil.Address, error) {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, chainCfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) != 1 {
+		return nil, errors.New("cannot determine a single address for output script")
+	}
+	return addrs[0], nil
+}
+
+// NewChildPaysForParent builds a child transaction that spends parent's
+// output at parentVout, with extraUnspents available as further inputs if
+// that output alone cannot cover the child, so that the combined package
+// feerate of parent and child meets targetPackageFeePerKb. It does not
+// check whether that output is unspent or belongs to w. This lets an unconfirmed, underpaying
+// parent be pushed through by a well-funded child (CPFP) instead of being
+// replaced outright.
+func NewChildPaysForParent(parent *BtcTransaction, parentVout uint32, extraUnspents []BtcUnspent,
+	targetPackageFeePerKb int64, changeAddress btcutil.Address, w *wallet.BtcWallet) (*BtcTransaction, error) {
+
+	if parent == nil {
+		return nil, errors.New("parent transaction is required")
+	}
+	if int(parentVout) >= len(parent.Tx.TxOut) {
+		return nil, errors.New("parentVout is out of range")
+	}
+
+	parentOut := parent.Tx.TxOut[parentVout]
+	parentAddr, err := scriptToAddress(parentOut.PkScript, parent.chainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// Virtual size: weight (stripped size * 3 + full size) / 4, rounded up.
+	parentVSize := (parent.Tx.SerializeSizeStripped()*3 + parent.Tx.SerializeSize() + 3) / 4
+	parentFee := parent.GetFee()
+
+	spendable := BtcUnspent{
+		TxID:         parent.GetTxid(),
+		Vout:         parentVout,
+		Amount:       SatoshiToBtc(parentOut.Value),
+		Address:      parentAddr.String(),
+		ScriptPubKey: hex.EncodeToString(parentOut.PkScript),
+	}
+	unspents := append([]BtcUnspent{spendable}, extraUnspents...)
+
+	// Solve for the child fee rate that, combined with the parent's
+	// already-paid fee, meets the package target: childFeeRate such that
+	// (parentFee + childFee) / (parentVSize + childVSize) == target.
+	// We approximate childVSize as a single input (sized by the parent
+	// output's script type), a single P2WPKH-sized output and fixed
+	// overhead, since exact vsize depends on the final signature.
+	childVSize := estimateInputVSize(spendable) + txsizes.P2WPKHOutputSize + 11
+	requiredTotalFee := btcutil.Amount(targetPackageFeePerKb) * btcutil.Amount(parentVSize+childVSize) / 1000
+	childFee := requiredTotalFee - btcutil.Amount(parentFee)
+	if childFee <= 0 {
+		return nil, errors.New("parent already meets the target package feerate")
+	}
+	childFeePerKb := int64(childFee) * 1000 / int64(childVSize)
+	if childFeePerKb <= 0 {
+		return nil, errors.New("computed child fee rate is not positive")
+	}
+
+	// The child has no payment outputs of its own: it sweeps the parent
+	// output, less the fee, entirely into changeAddress.
+	sweepAmount := parentOut.Value - int64(childFee)
+	if sweepAmount <= 0 {
+		return nil, errors.New("parent output cannot cover the required child fee")
+	}
+	outputs := []BtcOutput{{Address: changeAddress, Amount: sweepAmount}}
+
+	child, err := NewBtcTransaction(unspents, outputs, changeAddress, childFeePerKb, parent.chainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := child.Sign(w); err != nil {
+		return nil, err
+	}
+
+	return child, nil
+}
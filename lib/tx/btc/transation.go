@@ -25,6 +25,25 @@ type BtcUnspent struct {
 	RedeemScript string  `json:"redeemScript,omitempty"`
 	Amount       float64 `json:"amount"`
 	Address      string  `json:"address"`
+	// PrevTx is the raw hex-encoded transaction this unspent is an output
+	// of. It's only required for legacy (non-witness) inputs: ToPSBT needs
+	// the full previous transaction to build a PSBT NonWitnessUtxo for
+	// them, and has no way to fetch it itself.
+	PrevTx string `json:"prevTx,omitempty"`
+	// MasterKeyFingerprint and DerivationPath are optional and only
+	// needed for watch-only signing, where the caller doesn't hold a
+	// wallet.BtcWallet capable of looking derivation info up itself
+	// (e.g. a PSBT built for or received from an external signer).
+	MasterKeyFingerprint [4]byte  `json:"masterKeyFingerprint,omitempty"`
+	DerivationPath       []uint32 `json:"derivationPath,omitempty"`
+}
+
+// DerivationInfo is the BIP-32 derivation metadata for a single
+// transaction input, keyed by its position in BtcTransaction.Tx.TxIn.
+type DerivationInfo struct {
+	InputIndex           int
+	MasterKeyFingerprint [4]byte
+	DerivationPath       []uint32
 }
 
 type BtcOutput struct {
@@ -36,6 +55,11 @@ type BtcTransaction struct {
 	txauthor.AuthoredTx
 	chainParams *chaincfg.Params
 	feePerKb    int64
+	// unspents is the set of BtcUnspent entries that were selected as
+	// inputs for this transaction, in the same order as Tx.TxIn. It is
+	// kept around so the richer per-input metadata (redeem scripts,
+	// addresses, derivation info) can be recovered when building a PSBT.
+	unspents []BtcUnspent
 }
 
 func NewBtcTransaction(unspents []BtcUnspent, outputs []BtcOutput,
@@ -68,7 +92,9 @@ func NewBtcTransaction(unspents []BtcUnspent, outputs []BtcOutput,
 		ScriptSize: len(changeBytes),
 	}
 
-	unsignedTx, err := txauthor.NewUnsignedTransaction(txOuts, feeRatePerKb, makeInputSource(unspents), &changeSource)
+	inputSource, usedUnspents := makeInputSource(unspents)
+
+	unsignedTx, err := txauthor.NewUnsignedTransaction(txOuts, feeRatePerKb, inputSource, &changeSource)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +105,7 @@ func NewBtcTransaction(unspents []BtcUnspent, outputs []BtcOutput,
 		unsignedTx.RandomizeChangePosition()
 	}
 
-	return &BtcTransaction{*unsignedTx, chainCfg, feePerKb}, nil
+	return &BtcTransaction{*unsignedTx, chainCfg, feePerKb, usedUnspents()}, nil
 }
 
 func (t *BtcTransaction) Sign(wallet *wallet.BtcWallet) error {
@@ -112,6 +138,24 @@ func (t *BtcTransaction) HasChange() bool {
 	return t.ChangeIndex >= 0
 }
 
+// DerivationPaths returns the BIP-32 derivation metadata attached to each
+// input that carries one, in the order the inputs were selected. Inputs
+// whose BtcUnspent had no DerivationPath set are omitted.
+func (t *BtcTransaction) DerivationPaths() []DerivationInfo {
+	infos := make([]DerivationInfo, 0, len(t.unspents))
+	for i, u := range t.unspents {
+		if len(u.DerivationPath) == 0 {
+			continue
+		}
+		infos = append(infos, DerivationInfo{
+			InputIndex:           i,
+			MasterKeyFingerprint: u.MasterKeyFingerprint,
+			DerivationPath:       u.DerivationPath,
+		})
+	}
+	return infos
+}
+
 func (t *BtcTransaction) Serialize() (string, error) {
 	// Serialize the transaction and convert to hex string.
 	buf := bytes.NewBuffer(make([]byte, 0, t.Tx.SerializeSize()))
@@ -179,7 +223,11 @@ func makeTxOutputs(outputs []BtcOutput, relayFeePerKb btcutil.Amount, chainCfg *
 	return txOuts, nil
 }
 
-func makeInputSource(unspents []BtcUnspent) txauthor.InputSource {
+// makeInputSource builds a txauthor.InputSource that consumes unspents in
+// the order given until the target amount is reached. It also returns an
+// accessor for the subset of unspents that ended up selected, in input
+// order, once the source has been driven to completion.
+func makeInputSource(unspents []BtcUnspent) (txauthor.InputSource, func() []BtcUnspent) {
 	sz := len(unspents)
 	// Current inputs and their total value.  These are closed over by the
 	// returned input source and reused across multiple calls.
@@ -187,8 +235,9 @@ func makeInputSource(unspents []BtcUnspent) txauthor.InputSource {
 	currentInputs := make([]*wire.TxIn, 0, sz)
 	currentInputValues := make([]btcutil.Amount, 0, sz)
 	currentScripts := make([][]byte, 0, sz)
+	usedUnspents := make([]BtcUnspent, 0, sz)
 
-	return func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, []btcutil.Amount, [][]byte, error) {
+	source := func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, []btcutil.Amount, [][]byte, error) {
 		for currentTotal < target && len(unspents) != 0 {
 			u := unspents[0]
 			unspents = unspents[1:]
@@ -206,7 +255,10 @@ func makeInputSource(unspents []BtcUnspent) txauthor.InputSource {
 			currentInputs = append(currentInputs, nextInput)
 			currentInputValues = append(currentInputValues, amount)
 			currentScripts = append(currentScripts, s)
+			usedUnspents = append(usedUnspents, u)
 		}
 		return currentTotal, currentInputs, currentInputValues, currentScripts, nil
 	}
+
+	return source, func() []BtcUnspent { return usedUnspents }
 }